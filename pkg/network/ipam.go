@@ -1,163 +1,431 @@
 package network
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"math/big"
 	"net"
-	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 	"weike.sh/mydocker/util"
 )
 
+// bucketIDs is the name of the sub-bucket, nested inside every network's
+// bucket, that maps container ID -> JSON-encoded list of assigned IPs.
+var bucketIDs = []byte("ids")
+
+// lastIPKey is the reserved key inside a subnet's bucket holding the last
+// address handed out, so Allocate can resume scanning from there instead
+// of starting from the beginning of the subnet every time.
+var lastIPKey = []byte("lastIP")
+
+// Init makes sure every one of nw's subnets has a bucket to allocate
+// from, seeding its "last allocated" marker so Allocate has somewhere to
+// scan from.
 func (ipam *IPAM) Init(nw *Network) error {
-	if err := ipam.Load(); err != nil {
-		return fmt.Errorf("failed to load IPAllocation info: %v", err)
+	db, err := ipam.open()
+	if err != nil {
+		return err
 	}
+	defer db.Close()
 
-	// for subnet: 10.10.0.0/24, its mask is 255.255.255.0
-	// so 'ones' will be 24 and 'bits' will be 32.
-	ones, bits := nw.IPNet.Mask.Size()
-	size := 1 << uint8(bits-ones)
+	return db.Update(func(tx *bolt.Tx) error {
+		nwBucket, err := tx.CreateBucketIfNotExists([]byte(nw.Name))
+		if err != nil {
+			return fmt.Errorf("failed to create bucket for network %s: %v", nw.Name, err)
+		}
+		if _, err := nwBucket.CreateBucketIfNotExists(bucketIDs); err != nil {
+			return fmt.Errorf("failed to create ids bucket for network %s: %v", nw.Name, err)
+		}
 
-	// will init subnet's configurations if ipam
-	// allocated none ipaddr within this subnet.
-	if _, exist := (*ipam.SubnetBitMap)[nw.IPNet.String()]; exist {
+		for _, subnet := range nw.Subnets {
+			subnetBucket, err := nwBucket.CreateBucketIfNotExists([]byte(subnet.IPNet.String()))
+			if err != nil {
+				return fmt.Errorf("failed to create bucket for subnet %s: %v", subnet.IPNet, err)
+			}
+			if subnetBucket.Get(lastIPKey) == nil {
+				if err := subnetBucket.Put(lastIPKey, subnet.IPNet.IP); err != nil {
+					return err
+				}
+			}
+		}
 		return nil
-	}
-
-	// use "0" to fill the configurations of this subnet.
-	// 1<<uint8(bits-ones) means the number of available
-	// ip addresses in this subnet.
-	// e.g. there are 1<<8 = 256 available ip addresses
-	// for the subnet: 10.10.0.0/24
-	(*ipam.SubnetBitMap)[nw.IPNet.String()] = strings.Repeat("0", size)
-	return ipam.Dump()
+	})
 }
 
-func (ipam *IPAM) Allocate(nw *Network) (net.IP, error) {
-	if err := ipam.Load(); err != nil {
-		return nil, fmt.Errorf("failed to load IPAllocation info: %v", err)
+// Allocate hands containerID one address per subnet of nw. Each subnet is
+// scanned forward from the address after lastIP, wrapping back to the
+// start of the subnet, skipping the network, gateway and broadcast
+// addresses.
+func (ipam *IPAM) Allocate(containerID string, nw *Network) ([]net.IP, error) {
+	if err := ipam.Init(nw); err != nil {
+		return nil, err
 	}
 
-	if err := ipam.Init(nw); err != nil {
+	db, err := ipam.open()
+	if err != nil {
 		return nil, err
 	}
+	defer db.Close()
+
+	var ips []net.IP
+	err = db.Update(func(tx *bolt.Tx) error {
+		nwBucket := tx.Bucket([]byte(nw.Name))
+
+		for _, subnet := range nw.Subnets {
+			subnetBucket := nwBucket.Bucket([]byte(subnet.IPNet.String()))
+
+			ip, err := allocateFromSubnet(subnetBucket, subnet, containerID)
+			if err != nil {
+				return err
+			}
+			ips = append(ips, ip)
+		}
+
+		return recordContainerIPs(nwBucket.Bucket(bucketIDs), containerID, ips)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("allocated ip address(es) %v to container %s in network %s",
+		ips, containerID, nw.Name)
+
+	return ips, nil
+}
+
+// Release returns every address currently held by containerID in nw back
+// to the pool.
+func (ipam *IPAM) Release(containerID string, nw *Network) error {
+	db, err := ipam.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		nwBucket := tx.Bucket([]byte(nw.Name))
+		if nwBucket == nil {
+			return fmt.Errorf("network %s has not been initialized", nw.Name)
+		}
+		idsBucket := nwBucket.Bucket(bucketIDs)
+
+		ips, err := containerIPs(idsBucket, containerID)
+		if err != nil {
+			return err
+		}
+		if len(ips) == 0 {
+			return nil
+		}
 
-	// for subnet: 10.10.0/24, its mask is 255.255.255.0
-	// so 'ones' will be 24 and 'bits' will be 32.
-	ones, bits := nw.IPNet.Mask.Size()
-	size := 1 << uint8(bits-ones)
-
-	bitmapsStr := (*ipam.SubnetBitMap)[nw.IPNet.String()]
-	for index, bit := range bitmapsStr {
-		// the first ip address is kept for network
-		// the second ip address is kept for gateway
-		// the last ip address is kept for broadcast
-		if index > 1 && index < size-1 && bit == '0' {
-			bitmaps := []byte(bitmapsStr)
-			bitmaps[index] = '1'
-			(*ipam.SubnetBitMap)[nw.IPNet.String()] = string(bitmaps)
-
-			subnetIPInt := IP2Int(nw.IPNet.IP)
-			ip := Int2IP(subnetIPInt + uint32(index))
-			log.Debugf("allocate a new ip address %s from subnet %s",
-				ip, nw.IPNet.String())
-
-			nw.Counts++
-			if err := nw.Dump(); err != nil {
-				return nil, err
+		for _, ip := range ips {
+			subnet := subnetContaining(nw, ip)
+			if subnet == nil {
+				continue
 			}
 
-			return ip, ipam.Dump()
+			subnetBucket := nwBucket.Bucket([]byte(subnet.IPNet.String()))
+			if err := subnetBucket.Delete(normalizeIP(ip, len(subnet.IPNet.IP))); err != nil {
+				return err
+			}
 		}
+
+		return idsBucket.Delete([]byte(containerID))
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil, fmt.Errorf("failed to allocate a new ip address")
+	log.Debugf("released the ip address(es) held by container %s in network %s",
+		containerID, nw.Name)
+
+	return nil
 }
 
-func (ipam *IPAM) Release(nw *Network, ip *net.IP) error {
-	if err := ipam.Load(); err != nil {
-		return fmt.Errorf("failed to load IPAllocation info: %v", err)
+// ErrIPAlreadyAllocated is returned by AllocateSpecific when the
+// requested address is already held by another container.
+var ErrIPAlreadyAllocated = errors.New("ip address already allocated")
+
+// AllocateSpecific reserves ip for containerID instead of picking the
+// next free address, backing the --ip/--ip6 container-create flags. ip
+// must fall inside one of nw's subnets and must not be the network,
+// gateway or broadcast address.
+func (ipam *IPAM) AllocateSpecific(nw *Network, containerID string, ip net.IP) error {
+	subnet := subnetContaining(nw, ip)
+	if subnet == nil {
+		return fmt.Errorf("ip address %s is not inside any subnet of network %s", ip, nw.Name)
+	}
+	if isReserved(ip, subnet) {
+		return fmt.Errorf("ip address %s is reserved in subnet %s", ip, subnet.IPNet)
 	}
 
 	if err := ipam.Init(nw); err != nil {
 		return err
 	}
 
-	if len(*ipam.SubnetBitMap) == 0 {
-		return fmt.Errorf("the subnets allocator is empty")
+	db, err := ipam.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	key := normalizeIP(ip, len(subnet.IPNet.IP))
+	err = db.Update(func(tx *bolt.Tx) error {
+		nwBucket := tx.Bucket([]byte(nw.Name))
+		subnetBucket := nwBucket.Bucket([]byte(subnet.IPNet.String()))
+
+		if subnetBucket.Get(key) != nil {
+			return ErrIPAlreadyAllocated
+		}
+		if err := subnetBucket.Put(key, []byte(containerID)); err != nil {
+			return err
+		}
+
+		return recordContainerIPs(nwBucket.Bucket(bucketIDs), containerID, []net.IP{ip})
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("allocated static ip address %s to container %s in network %s",
+		ip, containerID, nw.Name)
+
+	return nil
+}
+
+// AllocatedCount returns the number of addresses currently reserved in
+// subnet, counted straight from the bbolt store rather than a cached
+// counter, so it can't drift out from under concurrent allocators the
+// way an in-memory/JSON-persisted count would.
+func (ipam *IPAM) AllocatedCount(nw *Network, subnet *Subnet) (int, error) {
+	db, err := ipam.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	count := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		nwBucket := tx.Bucket([]byte(nw.Name))
+		if nwBucket == nil {
+			return nil
+		}
+		subnetBucket := nwBucket.Bucket([]byte(subnet.IPNet.String()))
+		if subnetBucket == nil {
+			return nil
+		}
+
+		return subnetBucket.ForEach(func(k, _ []byte) error {
+			if string(k) != string(lastIPKey) {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// DeleteNetwork drops every allocation record kept for nw. It is called
+// once a network's last address has been released and the network itself
+// is being torn down.
+func (ipam *IPAM) DeleteNetwork(nw *Network) error {
+	db, err := ipam.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(nw.Name)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(nw.Name))
+	})
+}
+
+// allocateFromSubnet reserves the next free address in subnetBucket,
+// resuming the scan from the address after lastIP and wrapping around the
+// subnet. big.Int arithmetic is used throughout so the same code handles
+// both IPv4 /24s and IPv6 /64s, the latter being far too wide to index
+// with a uint32.
+func allocateFromSubnet(subnetBucket *bolt.Bucket, subnet *Subnet, containerID string) (net.IP, error) {
+	ipNet := subnet.IPNet
+	addrLen := len(ipNet.IP)
+
+	ones, bits := ipNet.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	base := IP2BigInt(ipNet.IP)
+	last := base
+	if raw := subnetBucket.Get(lastIPKey); raw != nil {
+		last = new(big.Int).SetBytes(raw)
 	}
 
-	bitmaps := []byte((*ipam.SubnetBitMap)[nw.IPNet.String()])
-	if len(bitmaps) == 0 {
-		return fmt.Errorf("the subnet %s has not been initialized",
-			nw.IPNet.String())
+	for i := big.NewInt(1); i.Cmp(size) <= 0; i.Add(i, big.NewInt(1)) {
+		offset := new(big.Int).Sub(last, base)
+		offset.Add(offset, i)
+		offset.Mod(offset, size)
+
+		ip := BigInt2IP(new(big.Int).Add(base, offset), addrLen)
+
+		if isReserved(ip, subnet) {
+			continue
+		}
+		if subnetBucket.Get(ip) != nil {
+			continue
+		}
+
+		if err := subnetBucket.Put(ip, []byte(containerID)); err != nil {
+			return nil, err
+		}
+		if err := subnetBucket.Put(lastIPKey, ip); err != nil {
+			return nil, err
+		}
+		return ip, nil
 	}
 
-	subnetIPInt := IP2Int(nw.IPNet.IP)
-	releaseIPInt := IP2Int(*ip)
-	index := int(releaseIPInt) - int(subnetIPInt)
+	return nil, fmt.Errorf("subnet %s has no free ip addresses", ipNet)
+}
 
-	log.Debugf("release the ipaddr: %s", *ip)
+// isReserved reports whether ip is the network address, the gateway (if
+// the subnet has one), or the IPv4 broadcast address, none of which may
+// be handed out.
+func isReserved(ip net.IP, subnet *Subnet) bool {
+	if ip.Equal(subnet.IPNet.IP) {
+		return true
+	}
+	if subnet.Gateway != nil && ip.Equal(subnet.Gateway.IP) {
+		return true
+	}
+	if bcast := broadcastAddr(subnet.IPNet); bcast != nil && ip.Equal(bcast) {
+		return true
+	}
+	return false
+}
 
-	if index <= 1 || index >= len(bitmaps) {
-		return fmt.Errorf("the ip addr '%s' is out of iprange", ip)
+// broadcastAddr returns ipNet's IPv4 broadcast address, or nil for IPv6
+// subnets, which have none.
+func broadcastAddr(ipNet *net.IPNet) net.IP {
+	ip4 := ipNet.IP.To4()
+	if ip4 == nil {
+		return nil
 	}
 
-	// in case release same ip addr multiple times.
-	if bitmaps[index] == '1' {
-		bitmaps[index] = '0'
-		(*ipam.SubnetBitMap)[nw.IPNet.String()] = string(bitmaps)
+	bcast := make(net.IP, len(ip4))
+	for i := range ip4 {
+		bcast[i] = ip4[i] | ^ipNet.Mask[i]
+	}
+	return bcast
+}
 
-		nw.Counts--
-		if err := nw.Dump(); err != nil {
-			return err
+// normalizeIP forces ip to the same byte length bolt keys and stored
+// addresses use for this subnet (4 bytes for IPv4, 16 for IPv6), since
+// net.IP round-tripped through JSON always comes back in 16-byte form.
+func normalizeIP(ip net.IP, addrLen int) net.IP {
+	if addrLen == net.IPv4len {
+		if v4 := ip.To4(); v4 != nil {
+			return v4
 		}
 	}
+	return ip.To16()
+}
 
-	return ipam.Dump()
+// subnetContaining returns the Subnet of nw that ip belongs to, or nil.
+func subnetContaining(nw *Network, ip net.IP) *Subnet {
+	for _, subnet := range nw.Subnets {
+		if subnet.IPNet.Contains(ip) {
+			return subnet
+		}
+	}
+	return nil
 }
 
-func (ipam *IPAM) Dump() error {
-	if err := util.EnSureFileExists(ipam.Allocator); err != nil {
+func recordContainerIPs(idsBucket *bolt.Bucket, containerID string, newIPs []net.IP) error {
+	ips, err := containerIPs(idsBucket, containerID)
+	if err != nil {
 		return err
 	}
+	ips = append(ips, newIPs...)
 
-	jsonBytes, err := json.Marshal(ipam.SubnetBitMap)
+	data, err := json.Marshal(ips)
 	if err != nil {
-		return fmt.Errorf("failed to json-encode ipam: %v", err)
+		return fmt.Errorf("failed to json-encode ip list for container %s: %v", containerID, err)
 	}
+	return idsBucket.Put([]byte(containerID), data)
+}
 
-	// WriteFile will create the file if it doesn't exist,
-	// otherwise WriteFile will truncate it before writing
-	if err := ioutil.WriteFile(ipam.Allocator, jsonBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write ipam config to file %s: %v",
-			ipam.Allocator, err)
+func containerIPs(idsBucket *bolt.Bucket, containerID string) ([]net.IP, error) {
+	raw := idsBucket.Get([]byte(containerID))
+	if len(raw) == 0 {
+		return nil, nil
 	}
 
-	return nil
+	var ips []net.IP
+	if err := json.Unmarshal(raw, &ips); err != nil {
+		return nil, fmt.Errorf("failed to json-decode ip list for container %s: %v", containerID, err)
+	}
+	return ips, nil
 }
 
-func (ipam *IPAM) Load() error {
+// open acquires ipam's bbolt database, which already serializes concurrent
+// writers via its own flock(2) on the db file, so Init/Allocate/Release
+// need no extra locking of their own.
+func (ipam *IPAM) open() (*bolt.DB, error) {
 	if err := util.EnSureFileExists(ipam.Allocator); err != nil {
-		return err
+		return nil, err
 	}
 
-	jsonBytes, err := ioutil.ReadFile(ipam.Allocator)
-	if len(jsonBytes) == 0 {
-		return nil
-	}
+	db, err := bolt.Open(ipam.Allocator, 0644, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
-		return fmt.Errorf("failed to read configFile %s: %v",
-			ipam.Allocator, err)
+		return nil, fmt.Errorf("failed to open ipam store %s: %v", ipam.Allocator, err)
 	}
+	return db, nil
+}
+
+// IP2Int converts a dotted-quad IPv4 address into its big-endian uint32
+// representation.
+func IP2Int(ip net.IP) uint32 {
+	ip = ip.To4()
+	return binary.BigEndian.Uint32(ip)
+}
 
-	ipam.SubnetBitMap = &map[string]string{}
-	if err := json.Unmarshal(jsonBytes, ipam.SubnetBitMap); err != nil {
-		return fmt.Errorf("failed to json-decode ipam: %v", err)
+// Int2IP is the inverse of IP2Int.
+func Int2IP(val uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, val)
+	return ip
+}
+
+// IP2BigInt converts an IPv4 or IPv6 address into a big.Int. Unlike
+// IP2Int it can represent a full /64, which overflows a uint32.
+func IP2BigInt(ip net.IP) *big.Int {
+	return new(big.Int).SetBytes(ip.To16())
+}
+
+// BigInt2IP is the inverse of IP2BigInt; size must be 4 for an IPv4
+// address or 16 for IPv6.
+func BigInt2IP(val *big.Int, size int) net.IP {
+	full := make([]byte, 16)
+	b := val.Bytes()
+	copy(full[16-len(b):], b)
+	return net.IP(full[16-size:])
+}
+
+// GetIPFromSubnetByIndex returns the address at offset index inside
+// ipNet, e.g. index 1 of 10.20.30.0/24 is 10.20.30.1. IPv6 subnets fall
+// back to big.Int arithmetic since a /64 is far too wide for a uint32
+// offset.
+func GetIPFromSubnetByIndex(ipNet *net.IPNet, index int64) *net.IPNet {
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		ip := Int2IP(IP2Int(ip4) + uint32(index))
+		return &net.IPNet{IP: ip, Mask: ipNet.Mask}
 	}
 
-	return nil
+	base := IP2BigInt(ipNet.IP)
+	ip := BigInt2IP(base.Add(base, big.NewInt(index)), len(ipNet.IP))
+	return &net.IPNet{IP: ip, Mask: ipNet.Mask}
 }
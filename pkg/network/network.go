@@ -30,37 +30,66 @@ func NewNetwork(ctx *cli.Context) (*Network, error) {
 		return nil, fmt.Errorf("missing --driver option")
 	}
 
-	subnet := ctx.String("subnet")
-	if subnet == "" {
-		return nil, fmt.Errorf("missing --subnet option")
-	}
+	internal := ctx.Bool("internal")
 
-	// e.g. parse "10.20.30.1/24" to "10.20.30.0/24"
-	_, ipNet, err := net.ParseCIDR(subnet)
-	if err != nil {
-		return nil, err
+	var customGateway net.IP
+	if gw := ctx.String("gateway"); gw != "" {
+		if internal {
+			return nil, fmt.Errorf("--gateway cannot be combined with --internal")
+		}
+		customGateway = net.ParseIP(gw)
+		if customGateway == nil {
+			return nil, fmt.Errorf("invalid --gateway address %q", gw)
+		}
 	}
 
-	// set the gateway ip as the first ip addr of the subnet.
-	// e.g. set gateway to 10.20.30.1 for subnet 10.20.30.0/24
-	gateway := GetIPFromSubnetByIndex(ipNet, 1)
+	cidrs := ctx.StringSlice("subnet")
 
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return nil, err
-	}
-	for _, addr := range addrs {
-		if addr.String() == gateway.String() {
-			return nil, fmt.Errorf("the subnet %s already exists", ipNet)
+	var subnets []*Subnet
+	if len(cidrs) == 0 {
+		// no --subnet given: auto-pick a free v4 block instead of
+		// failing outright.
+		ipNet, err := FreeSubnet(DefaultConfig.IPv4Pool, DefaultConfig.IPv4Prefix)
+		if err != nil {
+			return nil, err
+		}
+		subnets = []*Subnet{{IPNet: ipNet, Gateway: resolveGateway(ipNet, internal, customGateway)}}
+	} else {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
 		}
+
+		subnets = make([]*Subnet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			// e.g. parse "10.20.30.1/24" to "10.20.30.0/24"
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+
+			gateway := resolveGateway(ipNet, internal, customGateway)
+			if gateway != nil {
+				for _, addr := range addrs {
+					if addr.String() == gateway.String() {
+						return nil, fmt.Errorf("the subnet %s already exists", ipNet)
+					}
+				}
+			}
+
+			subnets = append(subnets, &Subnet{IPNet: ipNet, Gateway: gateway})
+		}
+	}
+
+	if customGateway != nil && !subnetsUseGateway(subnets, customGateway) {
+		return nil, fmt.Errorf("gateway %s is not inside any subnet of network %s", customGateway, name)
 	}
 
 	nw := &Network{
 		Name:       name,
-		Counts:     0,
 		Driver:     driver,
-		IPNet:      ipNet,
-		Gateway:    gateway,
+		Subnets:    subnets,
+		Internal:   internal,
 		CreateTime: time.Now().Format("2006-01-02 15:04:05"),
 	}
 
@@ -68,6 +97,92 @@ func NewNetwork(ctx *cli.Context) (*Network, error) {
 	return nw, nil
 }
 
+// resolveGateway picks ipNet's gateway: none for an internal network, the
+// caller-supplied customGateway when it falls inside ipNet, or else the
+// subnet's first usable address.
+//
+// internal withholds only the gateway/default-route half of isolation.
+// The other half - the driver installing an iptables DROP rule for
+// traffic leaving the bridge - belongs to the driver implementation,
+// which this tree doesn't have; see the Internal field's doc comment.
+func resolveGateway(ipNet *net.IPNet, internal bool, customGateway net.IP) *net.IPNet {
+	if internal {
+		return nil
+	}
+	if customGateway != nil && ipNet.Contains(customGateway) {
+		return &net.IPNet{IP: customGateway, Mask: ipNet.Mask}
+	}
+	return GetIPFromSubnetByIndex(ipNet, 1)
+}
+
+func subnetsUseGateway(subnets []*Subnet, gateway net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Gateway != nil && subnet.Gateway.IP.Equal(gateway) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssignStaticIP parses ipStr and reserves it for containerID in nw; see
+// IPAM.AllocateSpecific for the allocation rules.
+func AssignStaticIP(nw *Network, containerID, ipStr string) (net.IP, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %q", ipStr)
+	}
+
+	if err := IPAllocator.AllocateSpecific(nw, containerID, ip); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// IPFlags are the --ip/--ip6 flags a container-create command registers
+// to let a user pin a container to a specific address; AssignStaticIPs
+// reads them back off the parsed cli.Context.
+//
+// The container-create command lives outside pkg/network: nothing in this
+// package appends IPFlags to a command or calls AssignStaticIPs. IPFlags
+// and AssignStaticIPs are what this package offers that command.
+var IPFlags = []cli.Flag{
+	cli.StringFlag{Name: "ip", Usage: "assign a static IPv4 address from the network"},
+	cli.StringFlag{Name: "ip6", Usage: "assign a static IPv6 address from the network"},
+}
+
+// AssignStaticIPs reads --ip and --ip6 off ctx and reserves each one that
+// was given for containerID in nw, returning the addresses assigned.
+func AssignStaticIPs(ctx *cli.Context, nw *Network, containerID string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, flag := range []string{"ip", "ip6"} {
+		ipStr := ctx.String(flag)
+		if ipStr == "" {
+			continue
+		}
+
+		ip, err := AssignStaticIP(nw, containerID, ipStr)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// AllocatedCounts returns the number of addresses currently handed out
+// across every subnet of nw, read live from the IPAM store.
+func (nw *Network) AllocatedCounts() (int, error) {
+	total := 0
+	for _, subnet := range nw.Subnets {
+		count, err := IPAllocator.AllocatedCount(nw, subnet)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
 func (nw *Network) ConfigFileName() (string, error) {
 	configDir := path.Join(DriversDir, nw.Driver)
 	configFileName := path.Join(configDir, nw.Name+".json")
@@ -88,28 +203,41 @@ func (nw *Network) Create() error {
 }
 
 func (nw *Network) Delete() error {
-	if nw.Counts > 0 {
-		return fmt.Errorf("there still exist %d ips in subnet %s",
-			nw.Counts, nw.IPNet)
-	} else {
-		if err := IPAllocator.Init(nw); err != nil {
-			return err
-		}
-		delete(*IPAllocator.SubnetBitMap, nw.IPNet.String())
-		if err := IPAllocator.Dump(); err != nil {
-			return err
-		}
+	total, err := nw.AllocatedCounts()
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return fmt.Errorf("there still exist %d ips in network %s",
+			total, nw.Name)
+	}
+
+	if err := IPAllocator.DeleteNetwork(nw); err != nil {
+		return err
 	}
 
 	if err := Drivers[nw.Driver].Delete(nw); err != nil {
 		return err
 	}
 
-	if configFileName, err := nw.ConfigFileName(); err == nil {
-		return os.Remove(configFileName)
-	} else {
+	configFileName, err := nw.ConfigFileName()
+	if err != nil {
 		return err
 	}
+
+	lock, err := nw.configLock()
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if err := os.Remove(configFileName); err != nil {
+		return err
+	}
+	return os.Remove(configFileName + ".lock")
 }
 
 func (nw *Network) Dump() error {
@@ -118,15 +246,22 @@ func (nw *Network) Dump() error {
 		return err
 	}
 
+	lock, err := nw.configLock()
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	jsonBytes, err := json.Marshal(nw)
 	if err != nil {
 		return fmt.Errorf("failed to json-encode network %s: %v",
 			nw.Name, err)
 	}
 
-	// WriteFile will create the file if it doesn't exist,
-	// otherwise WriteFile will truncate it before writing
-	if err := ioutil.WriteFile(configFileName, jsonBytes, 0644); err != nil {
+	if err := util.WriteFileAtomic(configFileName, jsonBytes, 0644); err != nil {
 		return fmt.Errorf("failed to write network config to file %s: %v",
 			configFileName, err)
 	}
@@ -140,6 +275,15 @@ func (nw *Network) Load() error {
 		return err
 	}
 
+	lock, err := nw.configLock()
+	if err != nil {
+		return err
+	}
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	jsonBytes, err := ioutil.ReadFile(configFileName)
 	if len(jsonBytes) == 0 {
 		return nil
@@ -157,27 +301,43 @@ func (nw *Network) Load() error {
 	return nil
 }
 
-func (nw *Network) MarshalJSON() ([]byte, error) {
-	type nwAlias Network
+// configLock returns the FileLock guarding nw's config file against
+// concurrent Dump/Load from other mydocker processes.
+func (nw *Network) configLock() (*util.FileLock, error) {
+	configFileName, err := nw.ConfigFileName()
+	if err != nil {
+		return nil, err
+	}
+	return util.NewFileLock(configFileName + ".lock")
+}
+
+func (subnet *Subnet) MarshalJSON() ([]byte, error) {
+	type subnetAlias Subnet
+
+	var gateway string
+	if subnet.Gateway != nil {
+		gateway = subnet.Gateway.IP.String()
+	}
+
 	return json.Marshal(&struct {
 		IPNet   string `json:"IPNet"`
-		Gateway string `json:"Gateway"`
-		*nwAlias
+		Gateway string `json:"Gateway,omitempty"`
+		*subnetAlias
 	}{
-		IPNet:   nw.IPNet.String(),
-		Gateway: nw.Gateway.IP.String(),
-		nwAlias: (*nwAlias)(nw),
+		IPNet:       subnet.IPNet.String(),
+		Gateway:     gateway,
+		subnetAlias: (*subnetAlias)(subnet),
 	})
 }
 
-func (nw *Network) UnmarshalJSON(data []byte) error {
-	type nwAlias Network
+func (subnet *Subnet) UnmarshalJSON(data []byte) error {
+	type subnetAlias Subnet
 	aux := &struct {
 		IPNet   string `json:"IPNet"`
 		Gateway string `json:"Gateway"`
-		*nwAlias
+		*subnetAlias
 	}{
-		nwAlias: (*nwAlias)(nw),
+		subnetAlias: (*subnetAlias)(subnet),
 	}
 
 	if err := json.Unmarshal(data, aux); err != nil {
@@ -188,9 +348,19 @@ func (nw *Network) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
+	subnet.IPNet = ipNet
 
-	nw.IPNet = ipNet
-	nw.Gateway = GetIPFromSubnetByIndex(ipNet, 1)
+	// an internal network's subnet has no gateway at all.
+	if aux.Gateway == "" {
+		subnet.Gateway = nil
+		return nil
+	}
+
+	gatewayIP := net.ParseIP(aux.Gateway)
+	if gatewayIP == nil {
+		return fmt.Errorf("invalid gateway address %q", aux.Gateway)
+	}
+	subnet.Gateway = &net.IPNet{IP: gatewayIP, Mask: ipNet.Mask}
 
 	return nil
 }
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// Config tunes the pools FreeSubnet draws blocks from, and the prefix
+// length it hands out, whenever the caller does not name a --subnet
+// explicitly.
+type Config struct {
+	IPv4Pool   *net.IPNet
+	IPv4Prefix int
+	IPv6Pool   *net.IPNet
+	IPv6Prefix int
+}
+
+// DefaultConfig is the pool FreeSubnet draws from when --subnet is
+// omitted.
+var DefaultConfig = Config{
+	IPv4Pool:   mustParseCIDR("10.89.0.0/16"),
+	IPv4Prefix: 24,
+	IPv6Pool:   mustParseCIDR("fd00::/48"),
+	IPv6Prefix: 64,
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// NetsOverlap reports whether a and b share any address, i.e. either
+// one's network address falls inside the other.
+func NetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// FreeSubnet walks pool in prefixLen-sized blocks and returns the first
+// one that overlaps neither a subnet already recorded in Networks nor a
+// prefix currently assigned to a host interface.
+func FreeSubnet(pool *net.IPNet, prefixLen int) (*net.IPNet, error) {
+	ones, bits := pool.Mask.Size()
+	if prefixLen < ones || prefixLen > bits {
+		return nil, fmt.Errorf("prefix length /%d does not fit inside pool %s", prefixLen, pool)
+	}
+
+	hostSubnets, err := hostInterfaceSubnets()
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLen))
+	numBlocks := new(big.Int).Lsh(big.NewInt(1), uint(prefixLen-ones))
+	base := IP2BigInt(pool.IP)
+	mask := net.CIDRMask(prefixLen, bits)
+
+	for i := big.NewInt(0); i.Cmp(numBlocks) < 0; i.Add(i, big.NewInt(1)) {
+		offset := new(big.Int).Mul(i, blockSize)
+		blockIP := BigInt2IP(new(big.Int).Add(base, offset), bits/8)
+		candidate := &net.IPNet{IP: blockIP, Mask: mask}
+
+		if overlapsAny(candidate, hostSubnets) || overlapsAnyNetwork(candidate) {
+			continue
+		}
+		return candidate, nil
+	}
+
+	return nil, fmt.Errorf("no free /%d subnet available in pool %s", prefixLen, pool)
+}
+
+func overlapsAnyNetwork(candidate *net.IPNet) bool {
+	for _, nw := range Networks {
+		for _, subnet := range nw.Subnets {
+			if NetsOverlap(candidate, subnet.IPNet) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hostInterfaceSubnets() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets, nil
+}
+
+func overlapsAny(candidate *net.IPNet, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if NetsOverlap(candidate, n) {
+			return true
+		}
+	}
+	return false
+}
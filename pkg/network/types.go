@@ -0,0 +1,58 @@
+package network
+
+import (
+	"net"
+	"path"
+)
+
+// Driver wires up the kernel-level plumbing (bridge, veth pairs, iptables
+// rules, ...) behind a Network. Each driver registers itself in Drivers
+// under its own name.
+type Driver interface {
+	Name() string
+	Create(nw *Network) error
+	Delete(nw *Network) error
+}
+
+// Subnet is one of the (possibly several, for dual-stack) address ranges
+// a Network hands out IPs from. How many of its addresses are currently
+// allocated is derived from the IPAM store on demand (see
+// IPAM.AllocatedCount) rather than mirrored here, since two processes
+// updating a cached count independently can only ever drift.
+type Subnet struct {
+	IPNet   *net.IPNet
+	Gateway *net.IPNet
+}
+
+// Network is a user-created network and the subnet(s) it hands out
+// addresses from. A dual-stack network carries one IPv4 and one IPv6
+// Subnet; a v4-only or v6-only one carries just the one.
+type Network struct {
+	Name    string
+	Driver  string
+	Subnets []*Subnet
+	// Internal marks a network whose subnets have no gateway (see
+	// resolveGateway): no default route is handed out. The driver-side
+	// half of isolation - an iptables DROP rule for traffic leaving the
+	// bridge - still needs a driver implementation this tree doesn't
+	// have, so today Internal only withholds the gateway.
+	Internal   bool
+	CreateTime string
+}
+
+// IPAM hands out and reclaims IP addresses for a Network.
+type IPAM struct {
+	// Allocator is the path to the on-disk store backing this allocator.
+	Allocator string
+}
+
+var (
+	// DriversDir is where every driver keeps its per-network config files,
+	// one subdirectory per driver name.
+	DriversDir = "/var/lib/mydocker/network/network"
+
+	Networks = map[string]*Network{}
+	Drivers  = map[string]Driver{}
+
+	IPAllocator = &IPAM{Allocator: path.Join(DriversDir, "..", "ipam.db")}
+)
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// EnSureFileExists makes sure path, along with every parent directory,
+// exists on disk. If the file itself is missing it is created empty;
+// an already-present file (and its contents) is left untouched.
+func EnSureFileExists(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat file %s: %v", path, err)
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create file %s: %v", path, err)
+		}
+		return f.Close()
+	}
+
+	return nil
+}
+
+// WriteFileAtomic writes data to path by first writing it to a sidecar
+// "path.tmp" file and renaming that into place, so a crash mid-write can
+// never leave a truncated or empty file where path used to be.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("failed to write temp file %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", tmp, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileLock is an exclusive, cross-process lock backed by flock(2) on a
+// sidecar file. It guards a single Load -> mutate -> Dump critical
+// section; create one per use, don't share a FileLock across goroutines.
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// NewFileLock returns a FileLock guarding path, creating path and its
+// parent directory if they don't already exist.
+func NewFileLock(path string) (*FileLock, error) {
+	if err := EnSureFileExists(path); err != nil {
+		return nil, err
+	}
+	return &FileLock{path: path}, nil
+}
+
+// Lock blocks until it holds an exclusive lock on the underlying file.
+func (l *FileLock) Lock() error {
+	f, err := os.OpenFile(l.path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file %s: %v", l.path, err)
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to lock %s: %v", l.path, err)
+	}
+
+	l.file = f
+	return nil
+}
+
+// Unlock releases the lock and closes the underlying file descriptor.
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	defer func() {
+		l.file.Close()
+		l.file = nil
+	}()
+
+	return unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+}